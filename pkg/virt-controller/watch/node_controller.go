@@ -0,0 +1,418 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	virtv1 "kubevirt.io/kubevirt/pkg/api/v1"
+	"kubevirt.io/kubevirt/pkg/kubecli"
+	"kubevirt.io/kubevirt/pkg/log"
+)
+
+// DefaultUnresponsiveHandlerTaintGracePeriod is the default value for the
+// --unresponsive-handler-taint-grace-period flag: the amount of time we
+// tolerate virt-handler not reporting a heartbeat on a node before we taint
+// it and start evicting the VMs running on it.
+const DefaultUnresponsiveHandlerTaintGracePeriod = 5 * time.Minute
+
+// UnresponsiveHandlerTaintKey is applied, with a NoExecute effect, to nodes
+// whose virt-handler has been unresponsive for longer than
+// --unresponsive-handler-taint-grace-period. Using a taint rather than a
+// label lets node problem detector and the cluster autoscaler, which already
+// understand taints, react to the condition as well.
+const UnresponsiveHandlerTaintKey = "kubevirt.io/virt-handler-unresponsive"
+
+const (
+	// DisruptionConditionType marks a VM that was force-failed by the
+	// controller instead of failing on its own, e.g. because its node's
+	// virt-handler stopped reporting a heartbeat.
+	DisruptionConditionType virtv1.VirtualMachineConditionType = "Disrupted"
+
+	// ReasonVirtHandlerUnresponsive is used when the VM's node is still
+	// present but virt-handler on it has stopped reporting a heartbeat.
+	ReasonVirtHandlerUnresponsive = "VirtHandlerUnresponsive"
+)
+
+// NodeController watches nodes for a stale virt-handler heartbeat and fails
+// the VMs scheduled to them. Cleanup of VMs whose node has been deleted
+// entirely is handled separately by VMGCController, since that case needs
+// neither the taint/toleration bookkeeping nor the Disrupted condition this
+// controller records.
+type NodeController struct {
+	clientset                           kubecli.KubevirtClient
+	Queue                               workqueue.RateLimitingInterface
+	nodeInformer                        cache.SharedIndexInformer
+	vmInformer                          cache.SharedIndexInformer
+	recorder                            record.EventRecorder
+	unresponsiveHandlerTaintGracePeriod time.Duration
+}
+
+func NewNodeController(clientset kubecli.KubevirtClient, nodeInformer cache.SharedIndexInformer, vmInformer cache.SharedIndexInformer, recorder record.EventRecorder, unresponsiveHandlerTaintGracePeriod time.Duration) *NodeController {
+	c := &NodeController{
+		clientset:                           clientset,
+		Queue:                               workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		nodeInformer:                        nodeInformer,
+		vmInformer:                          vmInformer,
+		recorder:                            recorder,
+		unresponsiveHandlerTaintGracePeriod: unresponsiveHandlerTaintGracePeriod,
+	}
+
+	c.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueNode,
+		UpdateFunc: func(_, curr interface{}) { c.enqueueNode(curr) },
+	})
+
+	c.vmInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueueVirtualMachine,
+		UpdateFunc: func(_, curr interface{}) { c.enqueueVirtualMachine(curr) },
+	})
+
+	return c
+}
+
+func (c *NodeController) enqueueNode(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Log.Reason(err).Error("Failed to extract key from node.")
+		return
+	}
+	c.Queue.Add(key)
+}
+
+func (c *NodeController) enqueueVirtualMachine(obj interface{}) {
+	vm, ok := obj.(*virtv1.VirtualMachine)
+	if !ok {
+		return
+	}
+	if nodeName, exists := vm.Labels[virtv1.NodeNameLabel]; exists && nodeName != "" {
+		c.Queue.Add(nodeName)
+	}
+}
+
+// Run starts the node controller until ctx is cancelled.
+func (c *NodeController) Run(ctx context.Context, threadiness int) {
+	defer c.Queue.ShutDown()
+	log.Log.Info("Starting node controller.")
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.nodeInformer.HasSynced, c.vmInformer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+
+	<-ctx.Done()
+	log.Log.Info("Stopping node controller.")
+}
+
+func (c *NodeController) runWorker(ctx context.Context) {
+	for c.Execute(ctx) {
+	}
+}
+
+// Execute pops a single work item off the queue and processes it. It
+// returns false once the queue has been shut down.
+func (c *NodeController) Execute(ctx context.Context) bool {
+	key, quit := c.Queue.Get()
+	if quit {
+		return false
+	}
+	defer c.Queue.Done(key)
+
+	logger := log.FromContext(ctx).WithValues("node", key)
+	if err := c.execute(ctx, key.(string)); err != nil {
+		logger.Reason(err).Errorf("Re-enqueuing node %v.", key)
+		c.Queue.AddRateLimited(key)
+	} else {
+		c.Queue.Forget(key)
+	}
+	return true
+}
+
+func (c *NodeController) execute(ctx context.Context, key string) error {
+	obj, nodeExists, err := c.nodeInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !nodeExists {
+		// A deleted node is VMGCController's job: it force-deletes the VMs
+		// that were scheduled to it instead of failing them in place.
+		return nil
+	}
+
+	node := obj.(*k8sv1.Node).DeepCopy()
+	if isVirtHandlerResponsive(node, c.unresponsiveHandlerTaintGracePeriod) {
+		return c.untaintNodeResponsive(node)
+	}
+
+	taint, err := c.taintNodeUnresponsive(node)
+	if err != nil {
+		return err
+	}
+
+	vms, err := c.clientset.VM(v1.NamespaceAll).List(&v1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", virtv1.NodeNameLabel, key),
+	})
+	if err != nil {
+		return err
+	}
+
+	podList, err := c.clientset.CoreV1().Pods(k8sv1.NamespaceAll).List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	stuckVms := filterStuckVirtualMachinesWithoutPods(vmPointers(vms.Items), podPointers(podList.Items))
+	stuckVms = filterVirtualMachinesPastToleration(stuckVms, *taint)
+
+	message := fmt.Sprintf("virt-handler on node %s has not reported a heartbeat recently", node.Name)
+	var errs []string
+	for _, vm := range stuckVms {
+		if err := c.setVmToFailed(ctx, vm, ReasonVirtHandlerUnresponsive, message); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to fail %d vm(s): %s", len(errs), strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// taintNodeUnresponsive adds the UnresponsiveHandlerTaintKey taint to node if
+// it isn't already present, and returns the (possibly pre-existing) taint so
+// callers can use its TimeAdded to evaluate per-VM toleration windows.
+func (c *NodeController) taintNodeUnresponsive(node *k8sv1.Node) (*k8sv1.Taint, error) {
+	for i := range node.Spec.Taints {
+		if node.Spec.Taints[i].Key == UnresponsiveHandlerTaintKey {
+			return &node.Spec.Taints[i], nil
+		}
+	}
+
+	now := v1.Now()
+	taint := k8sv1.Taint{
+		Key:       UnresponsiveHandlerTaintKey,
+		Effect:    k8sv1.TaintEffectNoExecute,
+		TimeAdded: &now,
+	}
+	taints, err := json.Marshal(append(node.Spec.Taints, taint))
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(fmt.Sprintf(`{"spec": { "taints": %s }}`, string(taints)))
+	if _, err := c.clientset.CoreV1().Nodes().Patch(node.Name, types.MergePatchType, data); err != nil {
+		return nil, err
+	}
+	return &taint, nil
+}
+
+// untaintNodeResponsive removes the UnresponsiveHandlerTaintKey taint from
+// node if present. Without this, a node that recovers from a transient
+// heartbeat gap would stay tainted NoExecute forever, permanently evicting
+// every pod on it that doesn't tolerate the taint - not just kubevirt VMs.
+func (c *NodeController) untaintNodeResponsive(node *k8sv1.Node) error {
+	taints := make([]k8sv1.Taint, 0, len(node.Spec.Taints))
+	found := false
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == UnresponsiveHandlerTaintKey {
+			found = true
+			continue
+		}
+		taints = append(taints, taint)
+	}
+	if !found {
+		return nil
+	}
+
+	marshalledTaints, err := json.Marshal(taints)
+	if err != nil {
+		return err
+	}
+	data := []byte(fmt.Sprintf(`{"spec": { "taints": %s }}`, string(marshalledTaints)))
+	_, err = c.clientset.CoreV1().Nodes().Patch(node.Name, types.MergePatchType, data)
+	return err
+}
+
+// isVirtHandlerResponsive returns true if the node's virt-handler has
+// reported a heartbeat within gracePeriod.
+func isVirtHandlerResponsive(node *k8sv1.Node, gracePeriod time.Duration) bool {
+	heartbeat, exists := node.Annotations[virtv1.VirtHandlerHeartbeat]
+	if !exists {
+		return true
+	}
+	timestamp := v1.Time{}
+	if err := json.Unmarshal([]byte(`"`+heartbeat+`"`), &timestamp); err != nil {
+		return true
+	}
+	return time.Now().Before(timestamp.Add(gracePeriod))
+}
+
+// filterVirtualMachinesPastToleration returns the subset of vms which either
+// don't tolerate taint at all, or whose Spec.Tolerations grace period for it
+// has elapsed, mirroring how the Kubernetes taint manager honors
+// pod.Spec.Tolerations[].TolerationSeconds. A vm that tolerates the taint
+// indefinitely (no TolerationSeconds) is never past toleration, even if taint
+// has no TimeAdded to measure elapsed time against.
+func filterVirtualMachinesPastToleration(vms []*virtv1.VirtualMachine, taint k8sv1.Taint) []*virtv1.VirtualMachine {
+	past := []*virtv1.VirtualMachine{}
+	for _, vm := range vms {
+		tolerationSeconds, tolerates := tolerationSecondsFor(vm, taint)
+		if !tolerates {
+			past = append(past, vm)
+			continue
+		}
+		if tolerationSeconds == nil {
+			// tolerates the taint indefinitely
+			continue
+		}
+		if taint.TimeAdded != nil && time.Since(taint.TimeAdded.Time) < time.Duration(*tolerationSeconds)*time.Second {
+			continue
+		}
+		past = append(past, vm)
+	}
+	return past
+}
+
+// tolerationSecondsFor returns whether vm tolerates taint, and if so, for how
+// many seconds (nil meaning indefinitely).
+func tolerationSecondsFor(vm *virtv1.VirtualMachine, taint k8sv1.Taint) (tolerationSeconds *int64, tolerates bool) {
+	for _, toleration := range vm.Spec.Tolerations {
+		if toleration.Effect != "" && toleration.Effect != taint.Effect {
+			continue
+		}
+		if toleration.Key != "" && toleration.Key != taint.Key {
+			continue
+		}
+		switch toleration.Operator {
+		case k8sv1.TolerationOpExists, "":
+			return toleration.TolerationSeconds, true
+		case k8sv1.TolerationOpEqual:
+			if toleration.Value == "" {
+				return toleration.TolerationSeconds, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// filterStuckVirtualMachinesWithoutPods returns the subset of vms which are
+// in a running phase but have no pod backing them.
+func filterStuckVirtualMachinesWithoutPods(vms []*virtv1.VirtualMachine, pods []*k8sv1.Pod) []*virtv1.VirtualMachine {
+	stuck := []*virtv1.VirtualMachine{}
+
+	for _, vm := range vms {
+		if vm.IsFinal() {
+			continue
+		}
+		if vm.Status.Phase != virtv1.Running && vm.Status.Phase != virtv1.Scheduled {
+			continue
+		}
+		if podExistsForVirtualMachine(vm, pods) {
+			continue
+		}
+		stuck = append(stuck, vm)
+	}
+
+	return stuck
+}
+
+// podExistsForVirtualMachine reports whether one of pods is the pod backing
+// vm. Matching is done by pod UID rather than by namespace+DomainLabel: a
+// stale pod left behind by a previous VM incarnation can carry the same
+// name/namespace/label, and a legitimate pod can lose its label, so neither
+// is a reliable signal on its own.
+func podExistsForVirtualMachine(vm *virtv1.VirtualMachine, pods []*k8sv1.Pod) bool {
+	for _, pod := range pods {
+		if pod.Namespace != vm.Namespace {
+			continue
+		}
+		if podOwnedByVirtualMachine(pod, vm) {
+			return true
+		}
+	}
+	return false
+}
+
+// podOwnedByVirtualMachine matches solely on owner references. A pod created
+// before owner references were set on it (e.g. by an out-of-band or
+// pre-upgrade client) will not match here and its vm will be treated as
+// podless, which can force-fail a vm that is in fact still running.
+//
+// Closing that gap needs vm.Status.ActivePodUID, recorded by whichever
+// controller first schedules the vm's pod, as a fallback match. That field
+// and its write-path live in the VM-scheduling controller and
+// pkg/api/v1.VirtualMachineStatus, neither of which is part of this package —
+// tracked as a cross-package follow-up rather than silently left unhandled.
+func podOwnedByVirtualMachine(pod *k8sv1.Pod, vm *virtv1.VirtualMachine) bool {
+	for _, ref := range pod.OwnerReferences {
+		if ref.UID == vm.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// setVmToFailed marks the given VM as Failed and records a Disrupted
+// condition explaining why the controller, rather than the guest itself,
+// caused the transition. Both changes are sent as a single JSON patch so
+// the update is atomic.
+func (c *NodeController) setVmToFailed(ctx context.Context, vm *virtv1.VirtualMachine, reason, message string) error {
+	logger := log.FromContext(ctx).WithValues("node", vm.Status.NodeName, "vm", vm.Name)
+	data, err := buildFailedPatch(vm, reason, message)
+	if err != nil {
+		return err
+	}
+	_, err = c.clientset.VM(vm.ObjectMeta.Namespace).Patch(vm.ObjectMeta.Name, types.JSONPatchType, data)
+	if err != nil {
+		logger.Reason(err).Error("Failed to patch vm to Failed.")
+	}
+	return err
+}
+
+func buildFailedPatch(vm *virtv1.VirtualMachine, reason, message string) ([]byte, error) {
+	condition := virtv1.VirtualMachineCondition{
+		Type:               DisruptionConditionType,
+		Status:             k8sv1.ConditionTrue,
+		LastTransitionTime: v1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	conditions, err := json.Marshal(append(vm.Status.Conditions, condition))
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []string{
+		fmt.Sprintf(`{ "op": "test", "path": "/status/phase", "value": "%s" }`, vm.Status.Phase),
+		fmt.Sprintf(`{ "op": "replace", "path": "/status/phase", "value": "%s" }`, virtv1.Failed),
+		fmt.Sprintf(`{ "op": "replace", "path": "/status/conditions", "value": %s }`, string(conditions)),
+	}
+	return []byte(fmt.Sprintf(`[%s]`, strings.Join(ops, ","))), nil
+}
+
+func vmPointers(vms []virtv1.VirtualMachine) []*virtv1.VirtualMachine {
+	ptrs := make([]*virtv1.VirtualMachine, 0, len(vms))
+	for i := range vms {
+		ptrs = append(ptrs, &vms[i])
+	}
+	return ptrs
+}
+
+func podPointers(pods []k8sv1.Pod) []*k8sv1.Pod {
+	ptrs := make([]*k8sv1.Pod, 0, len(pods))
+	for i := range pods {
+		ptrs = append(ptrs, &pods[i])
+	}
+	return ptrs
+}
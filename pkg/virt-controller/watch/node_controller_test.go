@@ -1,6 +1,7 @@
 package watch
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"time"
@@ -36,7 +37,8 @@ var _ = Describe("Node controller with", func() {
 	var nodeInformer cache.SharedIndexInformer
 	var vmSource *framework.FakeControllerSource
 	var vmInformer cache.SharedIndexInformer
-	var stop chan struct{}
+	var ctx context.Context
+	var cancel context.CancelFunc
 	var controller *NodeController
 	var recorder *record.FakeRecorder
 	var mockQueue *testutils.MockWorkQueue
@@ -44,14 +46,14 @@ var _ = Describe("Node controller with", func() {
 	var kubeClient *fake.Clientset
 	var vmFeeder *testutils.VirtualMachineFeeder
 
-	syncCaches := func(stop chan struct{}) {
+	syncCaches := func(stop <-chan struct{}) {
 		go nodeInformer.Run(stop)
 		go vmInformer.Run(stop)
 		Expect(cache.WaitForCacheSync(stop, nodeInformer.HasSynced, vmInformer.HasSynced)).To(BeTrue())
 	}
 
 	BeforeEach(func() {
-		stop = make(chan struct{})
+		ctx, cancel = context.WithCancel(context.Background())
 		ctrl = gomock.NewController(GinkgoT())
 		virtClient = kubecli.NewMockKubevirtClient(ctrl)
 		vmInterface = kubecli.NewMockVMInterface(ctrl)
@@ -60,7 +62,7 @@ var _ = Describe("Node controller with", func() {
 		vmInformer, vmSource = testutils.NewFakeInformerFor(&virtv1.VirtualMachine{})
 		recorder = record.NewFakeRecorder(100)
 
-		controller = NewNodeController(virtClient, nodeInformer, vmInformer, recorder)
+		controller = NewNodeController(virtClient, nodeInformer, vmInformer, recorder, DefaultUnresponsiveHandlerTaintGracePeriod)
 		// Wrap our workqueue to have a way to detect when we are done processing updates
 		mockQueue = testutils.NewMockWorkQueue(controller.Queue)
 		controller.Queue = mockQueue
@@ -77,7 +79,7 @@ var _ = Describe("Node controller with", func() {
 			Expect(action).To(BeNil())
 			return true, nil, nil
 		})
-		syncCaches(stop)
+		syncCaches(ctx.Done())
 	})
 
 	addNode := func(node *k8sv1.Node) {
@@ -92,12 +94,6 @@ var _ = Describe("Node controller with", func() {
 		mockQueue.Wait()
 	}
 
-	deleteNode := func(node *k8sv1.Node) {
-		mockQueue.ExpectAdds(1)
-		nodeSource.Delete(node)
-		mockQueue.Wait()
-	}
-
 	Context("pods and vms given", func() {
 		It("should only select stuck vms", func() {
 			node := NewHealthyNode("test")
@@ -130,6 +126,30 @@ var _ = Describe("Node controller with", func() {
 			Expect(vms).To(ContainElement(vmWithoutPod))
 			Expect(vms).To(ContainElement(vmWithPodInDifferentNamespace))
 		})
+
+		It("should match pods by owner UID, not by namespace and domain label alone", func() {
+			vmWithStalePod := NewRunningVirtualMachine("vmWithStalePod", NewHealthyNode("test"))
+			stalePod := NewHealthyPodForVirtualMachine("stalePod", vmWithStalePod)
+			stalePod.OwnerReferences[0].UID = "some-other-uid"
+
+			vmOwningOtherPod := NewRunningVirtualMachine("vmOwningOtherPod", NewHealthyNode("test"))
+			otherVM := NewRunningVirtualMachine("otherVM", NewHealthyNode("test"))
+			podOfOtherVM := NewHealthyPodForVirtualMachine("podOfOtherVM", otherVM)
+
+			vms := filterStuckVirtualMachinesWithoutPods([]*virtv1.VirtualMachine{
+				vmWithStalePod,
+				vmOwningOtherPod,
+			}, []*k8sv1.Pod{
+				stalePod,
+				podOfOtherVM,
+			})
+
+			By("still treating a same-name/namespace pod with a different UID as missing")
+			Expect(vms).To(ContainElement(vmWithStalePod))
+
+			By("treating a pod owned by a different VM as missing")
+			Expect(vms).To(ContainElement(vmOwningOtherPod))
+		})
 	})
 
 	Context("responsive virt-handler given", func() {
@@ -138,12 +158,29 @@ var _ = Describe("Node controller with", func() {
 
 			addNode(node)
 
-			controller.Execute()
+			controller.Execute(ctx)
+		})
+		It("should remove the unresponsive-handler taint once virt-handler is responsive again", func() {
+			node := NewHealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{Key: UnresponsiveHandlerTaintKey, Effect: k8sv1.TaintEffectNoExecute},
+			}
+
+			addNode(node)
+
+			kubeClient.Fake.PrependReactor("patch", "nodes", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				patch, ok := action.(testing.PatchAction)
+				Expect(ok).To(BeTrue())
+				Expect(string(patch.GetPatch())).ToNot(ContainSubstring(UnresponsiveHandlerTaintKey))
+				return true, nil, nil
+			})
+
+			controller.Execute(ctx)
 		})
 	})
 
 	Context("unresponsive virt-handler given", func() {
-		It("should set the node to unschedulable", func() {
+		It("should taint the node as virt-handler-unresponsive", func() {
 			node := NewHealthyNode("testnode")
 			node.Annotations[virtv1.VirtHandlerHeartbeat] = nowAsJSONWithOffset(-10 * time.Minute)
 
@@ -152,13 +189,163 @@ var _ = Describe("Node controller with", func() {
 			kubeClient.Fake.PrependReactor("patch", "nodes", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
 				patch, ok := action.(testing.PatchAction)
 				Expect(ok).To(BeTrue())
-				Expect(string(patch.GetPatch())).To(Equal(`{"metadata": { "labels": {"kubevirt.io/schedulable": "false"}}}`))
+				Expect(string(patch.GetPatch())).To(ContainSubstring(`"key":"kubevirt.io/virt-handler-unresponsive"`))
+				Expect(string(patch.GetPatch())).To(ContainSubstring(`"effect":"NoExecute"`))
 				return true, nil, nil
 			})
 
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{}, nil)
 
-			controller.Execute()
+			controller.Execute(ctx)
+		})
+		It("should not re-taint a node that already carries the taint", func() {
+			node := NewUnhealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{Key: UnresponsiveHandlerTaintKey, Effect: k8sv1.TaintEffectNoExecute},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{}, nil)
+
+			controller.Execute(ctx)
+		})
+		It("should keep a vm whose toleration for the taint has not elapsed yet", func() {
+			node := NewUnhealthyNode("testnode")
+			vm := NewRunningVirtualMachine("vm1", node)
+			tolerationSeconds := int64(3600)
+			vm.Spec.Tolerations = []k8sv1.Toleration{
+				{
+					Key:               UnresponsiveHandlerTaintKey,
+					Operator:          k8sv1.TolerationOpExists,
+					Effect:            k8sv1.TaintEffectNoExecute,
+					TolerationSeconds: &tolerationSeconds,
+				},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
+
+			controller.Execute(ctx)
+		})
+		It("should fail a vm whose toleration for the taint has elapsed", func() {
+			node := NewUnhealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{
+					Key:       UnresponsiveHandlerTaintKey,
+					Effect:    k8sv1.TaintEffectNoExecute,
+					TimeAdded: &v1.Time{Time: time.Now().Add(-2 * time.Hour)},
+				},
+			}
+			vm := NewRunningVirtualMachine("vm1", node)
+			tolerationSeconds := int64(60)
+			vm.Spec.Tolerations = []k8sv1.Toleration{
+				{
+					Key:               UnresponsiveHandlerTaintKey,
+					Operator:          k8sv1.TolerationOpExists,
+					Effect:            k8sv1.TaintEffectNoExecute,
+					TolerationSeconds: &tolerationSeconds,
+				},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
+			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
+
+			controller.Execute(ctx)
+		})
+		It("should keep a vm that tolerates the taint indefinitely", func() {
+			node := NewUnhealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{
+					Key:       UnresponsiveHandlerTaintKey,
+					Effect:    k8sv1.TaintEffectNoExecute,
+					TimeAdded: &v1.Time{Time: time.Now().Add(-999 * time.Hour)},
+				},
+			}
+			vm := NewRunningVirtualMachine("vm1", node)
+			vm.Spec.Tolerations = []k8sv1.Toleration{
+				{
+					Key:      UnresponsiveHandlerTaintKey,
+					Operator: k8sv1.TolerationOpExists,
+					Effect:   k8sv1.TaintEffectNoExecute,
+				},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
+
+			controller.Execute(ctx)
+		})
+		It("should keep a vm that tolerates the taint indefinitely even if the taint has no TimeAdded", func() {
+			node := NewUnhealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{
+					Key:    UnresponsiveHandlerTaintKey,
+					Effect: k8sv1.TaintEffectNoExecute,
+				},
+			}
+			vm := NewRunningVirtualMachine("vm1", node)
+			vm.Spec.Tolerations = []k8sv1.Toleration{
+				{
+					Key:      UnresponsiveHandlerTaintKey,
+					Operator: k8sv1.TolerationOpExists,
+					Effect:   k8sv1.TaintEffectNoExecute,
+				},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
+
+			controller.Execute(ctx)
+		})
+		It("should fail a vm with a finite toleration when the taint has no TimeAdded", func() {
+			node := NewUnhealthyNode("testnode")
+			node.Spec.Taints = []k8sv1.Taint{
+				{
+					Key:    UnresponsiveHandlerTaintKey,
+					Effect: k8sv1.TaintEffectNoExecute,
+				},
+			}
+			vm := NewRunningVirtualMachine("vm1", node)
+			tolerationSeconds := int64(60)
+			vm.Spec.Tolerations = []k8sv1.Toleration{
+				{
+					Key:               UnresponsiveHandlerTaintKey,
+					Operator:          k8sv1.TolerationOpExists,
+					Effect:            k8sv1.TaintEffectNoExecute,
+					TolerationSeconds: &tolerationSeconds,
+				},
+			}
+
+			addNode(node)
+			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
+				return true, &k8sv1.PodList{}, nil
+			})
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
+			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
+
+			controller.Execute(ctx)
 		})
 		table.DescribeTable("should set a vm without a pod to failed state if the vm is in ", func(phase virtv1.VMPhase) {
 			node := NewUnhealthyNode("testnode")
@@ -173,7 +360,7 @@ var _ = Describe("Node controller with", func() {
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
 			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
 
-			controller.Execute()
+			controller.Execute(ctx)
 		},
 			table.Entry("running state", virtv1.Running),
 			table.Entry("scheduled state", virtv1.Scheduled),
@@ -194,7 +381,7 @@ var _ = Describe("Node controller with", func() {
 			vmInterface.EXPECT().Patch(vm1.Name, types.JSONPatchType, gomock.Any()).Return(nil, fmt.Errorf("some error")).Times(1)
 			vmInterface.EXPECT().Patch(vm2.Name, types.JSONPatchType, gomock.Any()).Times(1)
 
-			controller.Execute()
+			controller.Execute(ctx)
 		})
 		It("should set a vm without a pod to failed state, triggered by vm add event", func() {
 			node := NewUnhealthyNode("testnode")
@@ -208,7 +395,7 @@ var _ = Describe("Node controller with", func() {
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
 			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
 
-			controller.Execute()
+			controller.Execute(ctx)
 		})
 		It("should set a vm without a pod to failed state, triggered by node update", func() {
 			node := NewUnhealthyNode("testnode")
@@ -223,22 +410,7 @@ var _ = Describe("Node controller with", func() {
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
 			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
 
-			controller.Execute()
-		})
-		It("should set a vm without a pod to failed state, triggered by node delete", func() {
-			node := NewUnhealthyNode("testnode")
-			vm := NewRunningVirtualMachine("vm1", node)
-
-			nodeInformer.GetStore().Add(node)
-			deleteNode(node.DeepCopy())
-			kubeClient.Fake.PrependReactor("list", "pods", func(action testing.Action) (handled bool, obj runtime.Object, err error) {
-				return true, &k8sv1.PodList{}, nil
-			})
-
-			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
-			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
-
-			controller.Execute()
+			controller.Execute(ctx)
 		})
 		It("should set a vm without a pod to failed state, triggered by vm modify event", func() {
 			node := NewUnhealthyNode("testnode")
@@ -253,7 +425,7 @@ var _ = Describe("Node controller with", func() {
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
 			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
 
-			controller.Execute()
+			controller.Execute(ctx)
 		})
 		table.DescribeTable("should ignore a vm without a pod if the vm is in ", func(phase virtv1.VMPhase) {
 			node := NewUnhealthyNode("testnode")
@@ -267,7 +439,7 @@ var _ = Describe("Node controller with", func() {
 
 			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{Items: []virtv1.VirtualMachine{*vm}}, nil)
 
-			controller.Execute()
+			controller.Execute(ctx)
 		},
 			table.Entry("unprocessed state", virtv1.VmPhaseUnset),
 			table.Entry("pending state", virtv1.Pending),
@@ -291,15 +463,47 @@ var _ = Describe("Node controller with", func() {
 			By("checking that only a vm with a pod gets removed")
 			vmInterface.EXPECT().Patch(vm.Name, types.JSONPatchType, gomock.Any())
 
-			controller.Execute()
+			controller.Execute(ctx)
 		},
 			table.Entry("running state", virtv1.Running),
 			table.Entry("scheduled state", virtv1.Scheduled),
 		)
 	})
 
+	Context("a vm that is being force-failed", func() {
+		It("should record a Disrupted condition with the virt-handler-unresponsive reason in the patch", func() {
+			vm := NewRunningVirtualMachine("vm1", NewUnhealthyNode("testnode"))
+			message := "virt-handler on node testnode has not reported a heartbeat recently"
+
+			patch, err := buildFailedPatch(vm, ReasonVirtHandlerUnresponsive, message)
+			Expect(err).ToNot(HaveOccurred())
+
+			var ops []map[string]interface{}
+			Expect(json.Unmarshal(patch, &ops)).To(Succeed())
+
+			Expect(ops).To(ContainElement(HaveKeyWithValue("path", "/status/phase")))
+
+			var conditionsOp map[string]interface{}
+			for _, op := range ops {
+				if op["path"] == "/status/conditions" {
+					conditionsOp = op
+				}
+			}
+			Expect(conditionsOp).ToNot(BeNil())
+
+			conditions, ok := conditionsOp["value"].([]interface{})
+			Expect(ok).To(BeTrue())
+			Expect(conditions).To(HaveLen(1))
+
+			condition := conditions[0].(map[string]interface{})
+			Expect(condition["type"]).To(Equal(string(DisruptionConditionType)))
+			Expect(condition["reason"]).To(Equal(ReasonVirtHandlerUnresponsive))
+			Expect(condition["message"]).To(Equal(message))
+		})
+	})
+
 	AfterEach(func() {
-		close(stop)
+		cancel()
 		// Ensure that we add checks for expected events to every test
 		Expect(recorder.Events).To(BeEmpty())
 		ctrl.Finish()
@@ -339,7 +543,7 @@ func nowAsJSONWithOffset(offset time.Duration) string {
 
 func NewRunningVirtualMachine(vmName string, node *k8sv1.Node) *virtv1.VirtualMachine {
 	vm := virtv1.NewMinimalVM(vmName)
-	vm.UID = "1234"
+	vm.UID = types.UID(vmName + "-uid")
 	vm.Status.Phase = virtv1.Running
 	vm.Status.NodeName = node.Name
 	addInitializedAnnotation(vm)
@@ -357,6 +561,9 @@ func NewHealthyPodForVirtualMachine(podName string, vm *virtv1.VirtualMachine) *
 			Labels: map[string]string{
 				virtv1.DomainLabel: vm.Name,
 			},
+			OwnerReferences: []v1.OwnerReference{
+				{Kind: "VirtualMachine", Name: vm.Name, UID: vm.UID},
+			},
 		},
 		Spec: k8sv1.PodSpec{NodeName: vm.Status.NodeName}}
 }
@@ -0,0 +1,338 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	virtv1 "kubevirt.io/kubevirt/pkg/api/v1"
+	"kubevirt.io/kubevirt/pkg/kubecli"
+	"kubevirt.io/kubevirt/pkg/log"
+)
+
+// DefaultTerminatedVMGCThreshold is the default value for the
+// --terminated-vm-threshold flag: the number of Succeeded/Failed VMs kept
+// per namespace before the oldest ones are garbage collected. Zero disables
+// threshold-based pruning.
+const DefaultTerminatedVMGCThreshold = 0
+
+// vmGCPruneKeyPrefix marks queue items asking for a namespace's terminated
+// VMs to be pruned down to the threshold, as opposed to a plain
+// "namespace/name" item asking for a single VM to be force-deleted.
+const vmGCPruneKeyPrefix = "prune:"
+
+// VMGCController cleans up VirtualMachines that neither Kubernetes' garbage
+// collection nor NodeController's heartbeat-based failover reaches: VMs
+// whose node was deleted out from under them, modeled after
+// k8s.io/kubernetes' PodGCController, plus a configurable cap on how many
+// terminated VMs each namespace is allowed to retain.
+type VMGCController struct {
+	clientset             kubecli.KubevirtClient
+	Queue                 workqueue.RateLimitingInterface
+	vmInformer            cache.SharedIndexInformer
+	nodeInformer          cache.SharedIndexInformer
+	recorder              record.EventRecorder
+	terminatedVMThreshold int
+
+	vmsByNodeLock sync.RWMutex
+	// vmsByNode indexes VM keys ("namespace/name") by the node they're
+	// scheduled to, so a node deletion only enqueues the VMs it actually
+	// affects instead of a full VM list.
+	vmsByNode map[string]map[string]struct{}
+}
+
+func NewVMGCController(clientset kubecli.KubevirtClient, vmInformer cache.SharedIndexInformer, nodeInformer cache.SharedIndexInformer, recorder record.EventRecorder, terminatedVMThreshold int) *VMGCController {
+	c := &VMGCController{
+		clientset:             clientset,
+		Queue:                 workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		vmInformer:            vmInformer,
+		nodeInformer:          nodeInformer,
+		recorder:              recorder,
+		terminatedVMThreshold: terminatedVMThreshold,
+		vmsByNode:             map[string]map[string]struct{}{},
+	}
+
+	c.vmInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addVirtualMachine,
+		UpdateFunc: c.updateVirtualMachine,
+		DeleteFunc: c.deleteVirtualMachine,
+	})
+
+	c.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.enqueueVmsForDeletedNode,
+	})
+
+	return c
+}
+
+func (c *VMGCController) addVirtualMachine(obj interface{}) {
+	vm, ok := obj.(*virtv1.VirtualMachine)
+	if !ok {
+		return
+	}
+	c.indexVirtualMachine(vm)
+	if vm.IsFinal() {
+		c.enqueuePrune(vm.Namespace)
+	}
+}
+
+func (c *VMGCController) updateVirtualMachine(old, curr interface{}) {
+	oldVm, ok := old.(*virtv1.VirtualMachine)
+	if !ok {
+		return
+	}
+	vm, ok := curr.(*virtv1.VirtualMachine)
+	if !ok {
+		return
+	}
+
+	if oldVm.Labels[virtv1.NodeNameLabel] != vm.Labels[virtv1.NodeNameLabel] {
+		c.unindexVirtualMachine(oldVm)
+	}
+	c.indexVirtualMachine(vm)
+
+	if !oldVm.IsFinal() && vm.IsFinal() {
+		c.enqueuePrune(vm.Namespace)
+	}
+}
+
+func (c *VMGCController) deleteVirtualMachine(obj interface{}) {
+	vm, ok := obj.(*virtv1.VirtualMachine)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			log.Log.Reason(fmt.Errorf("unexpected object %#v", obj)).Error("Failed to process VM delete notification.")
+			return
+		}
+		vm, ok = tombstone.Obj.(*virtv1.VirtualMachine)
+		if !ok {
+			log.Log.Reason(fmt.Errorf("unexpected tombstone object %#v", tombstone.Obj)).Error("Failed to process VM delete notification.")
+			return
+		}
+	}
+	c.unindexVirtualMachine(vm)
+}
+
+// enqueueVmsForDeletedNode is the node informer's DeleteFunc: it looks up the
+// VMs that were indexed against the deleted node and enqueues exactly those
+// for force-deletion, rather than falling through to a full VM/pod scan.
+func (c *VMGCController) enqueueVmsForDeletedNode(obj interface{}) {
+	nodeName, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Log.Reason(err).Error("Failed to extract key from node.")
+		return
+	}
+
+	c.vmsByNodeLock.RLock()
+	vmKeys := make([]string, 0, len(c.vmsByNode[nodeName]))
+	for vmKey := range c.vmsByNode[nodeName] {
+		vmKeys = append(vmKeys, vmKey)
+	}
+	c.vmsByNodeLock.RUnlock()
+
+	for _, vmKey := range vmKeys {
+		c.Queue.Add(vmKey)
+	}
+}
+
+func (c *VMGCController) enqueuePrune(namespace string) {
+	if c.terminatedVMThreshold <= 0 {
+		return
+	}
+	c.Queue.Add(vmGCPruneKeyPrefix + namespace)
+}
+
+func (c *VMGCController) indexVirtualMachine(vm *virtv1.VirtualMachine) {
+	nodeName, exists := vm.Labels[virtv1.NodeNameLabel]
+	if !exists || nodeName == "" {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(vm)
+	if err != nil {
+		return
+	}
+
+	c.vmsByNodeLock.Lock()
+	defer c.vmsByNodeLock.Unlock()
+	if c.vmsByNode[nodeName] == nil {
+		c.vmsByNode[nodeName] = map[string]struct{}{}
+	}
+	c.vmsByNode[nodeName][key] = struct{}{}
+}
+
+func (c *VMGCController) unindexVirtualMachine(vm *virtv1.VirtualMachine) {
+	nodeName, exists := vm.Labels[virtv1.NodeNameLabel]
+	if !exists || nodeName == "" {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(vm)
+	if err != nil {
+		return
+	}
+
+	c.vmsByNodeLock.Lock()
+	defer c.vmsByNodeLock.Unlock()
+	delete(c.vmsByNode[nodeName], key)
+	if len(c.vmsByNode[nodeName]) == 0 {
+		delete(c.vmsByNode, nodeName)
+	}
+}
+
+// Run starts the VM GC controller until ctx is cancelled.
+func (c *VMGCController) Run(ctx context.Context, threadiness int) {
+	defer c.Queue.ShutDown()
+	log.Log.Info("Starting VM GC controller.")
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.vmInformer.HasSynced, c.nodeInformer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < threadiness; i++ {
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+
+	<-ctx.Done()
+	log.Log.Info("Stopping VM GC controller.")
+}
+
+func (c *VMGCController) runWorker(ctx context.Context) {
+	for c.Execute(ctx) {
+	}
+}
+
+// Execute pops a single work item off the queue and processes it. It
+// returns false once the queue has been shut down.
+func (c *VMGCController) Execute(ctx context.Context) bool {
+	key, quit := c.Queue.Get()
+	if quit {
+		return false
+	}
+	defer c.Queue.Done(key)
+
+	keyStr := key.(string)
+	logField, logValue := vmGCLogFieldFor(keyStr)
+	logger := log.FromContext(ctx).WithValues(logField, logValue)
+	if err := c.execute(ctx, keyStr); err != nil {
+		logger.Reason(err).Errorf("Re-enqueuing %v.", key)
+		c.Queue.AddRateLimited(key)
+	} else {
+		c.Queue.Forget(key)
+	}
+	return true
+}
+
+func (c *VMGCController) execute(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, vmGCPruneKeyPrefix) {
+		return c.pruneTerminatedVms(ctx, strings.TrimPrefix(key, vmGCPruneKeyPrefix))
+	}
+	return c.forceDeleteVm(ctx, key)
+}
+
+// vmGCLogFieldFor returns the log field name and value to tag a queue item
+// with: the queue holds either a "namespace/name" VM key or a
+// vmGCPruneKeyPrefix-prefixed namespace, never a node name, so unlike
+// NodeController's queue it's never logged as "node".
+func vmGCLogFieldFor(key string) (string, string) {
+	if strings.HasPrefix(key, vmGCPruneKeyPrefix) {
+		return "namespace", strings.TrimPrefix(key, vmGCPruneKeyPrefix)
+	}
+	return "vm", key
+}
+
+// forceDeleteVm deletes the VM named by key (a "namespace/name" string) with
+// a zero grace period: its node is gone, so there's nothing left to signal
+// for a graceful shutdown.
+//
+// key was snapshotted when the node was deleted and may have sat in the
+// rate-limited queue since, so it re-fetches the VM and re-confirms its node
+// is still missing before deleting, and guards the delete itself with a UID
+// precondition in case the VM was replaced in the meantime.
+func (c *VMGCController) forceDeleteVm(ctx context.Context, key string) error {
+	logger := log.FromContext(ctx).WithValues("vm", key)
+
+	obj, exists, err := c.vmInformer.GetStore().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	vm := obj.(*virtv1.VirtualMachine)
+
+	nodeName := vm.Labels[virtv1.NodeNameLabel]
+	if nodeName == "" {
+		return nil
+	}
+	if _, nodeExists, err := c.nodeInformer.GetStore().GetByKey(nodeName); err != nil {
+		return err
+	} else if nodeExists {
+		// The VM's node is back (or it was rescheduled elsewhere and the
+		// informer hasn't caught up yet); either way, it's no longer ours
+		// to force-delete.
+		return nil
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	gracePeriod := int64(0)
+	err = c.clientset.VM(namespace).Delete(name, &v1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+		Preconditions:      &v1.Preconditions{UID: &vm.UID},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		logger.Reason(err).Error("Failed to force-delete vm.")
+		return err
+	}
+	return nil
+}
+
+// pruneTerminatedVms deletes the oldest Succeeded/Failed VMs in namespace
+// once their count exceeds terminatedVMThreshold.
+func (c *VMGCController) pruneTerminatedVms(ctx context.Context, namespace string) error {
+	logger := log.FromContext(ctx).WithValues("namespace", namespace)
+	vms, err := c.clientset.VM(namespace).List(&v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	terminated := make([]*virtv1.VirtualMachine, 0, len(vms.Items))
+	for i := range vms.Items {
+		if vms.Items[i].IsFinal() {
+			terminated = append(terminated, &vms.Items[i])
+		}
+	}
+	if len(terminated) <= c.terminatedVMThreshold {
+		return nil
+	}
+
+	sort.Slice(terminated, func(i, j int) bool {
+		return terminated[i].CreationTimestamp.Before(&terminated[j].CreationTimestamp)
+	})
+	excess := terminated[:len(terminated)-c.terminatedVMThreshold]
+
+	var errs []string
+	for _, vm := range excess {
+		if err := c.clientset.VM(vm.Namespace).Delete(vm.Name, &v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		err := fmt.Errorf("failed to gc %d terminated vm(s) in namespace %s: %s", len(errs), namespace, strings.Join(errs, ", "))
+		logger.Reason(err).Error("Failed to gc terminated vms.")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package watch
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/cache/testing"
+	"k8s.io/client-go/tools/record"
+
+	virtv1 "kubevirt.io/kubevirt/pkg/api/v1"
+	"kubevirt.io/kubevirt/pkg/kubecli"
+	"kubevirt.io/kubevirt/pkg/log"
+	"kubevirt.io/kubevirt/pkg/testutils"
+)
+
+var _ = Describe("VM GC controller with", func() {
+	log.Log.SetIOWriter(GinkgoWriter)
+
+	var ctrl *gomock.Controller
+	var vmInterface *kubecli.MockVMInterface
+	var nodeSource *framework.FakeControllerSource
+	var nodeInformer cache.SharedIndexInformer
+	var vmInformer cache.SharedIndexInformer
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var controller *VMGCController
+	var recorder *record.FakeRecorder
+	var mockQueue *testutils.MockWorkQueue
+	var virtClient *kubecli.MockKubevirtClient
+
+	syncCaches := func(stop <-chan struct{}) {
+		go nodeInformer.Run(stop)
+		go vmInformer.Run(stop)
+		Expect(cache.WaitForCacheSync(stop, nodeInformer.HasSynced, vmInformer.HasSynced)).To(BeTrue())
+	}
+
+	newController := func(terminatedVMThreshold int) {
+		controller = NewVMGCController(virtClient, vmInformer, nodeInformer, recorder, terminatedVMThreshold)
+		mockQueue = testutils.NewMockWorkQueue(controller.Queue)
+		controller.Queue = mockQueue
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		ctrl = gomock.NewController(GinkgoT())
+		virtClient = kubecli.NewMockKubevirtClient(ctrl)
+		vmInterface = kubecli.NewMockVMInterface(ctrl)
+
+		nodeInformer, nodeSource = testutils.NewFakeInformerFor(&k8sv1.Node{})
+		vmInformer, _ = testutils.NewFakeInformerFor(&virtv1.VirtualMachine{})
+		recorder = record.NewFakeRecorder(100)
+
+		virtClient.EXPECT().VM(gomock.Any()).Return(vmInterface).AnyTimes()
+
+		newController(DefaultTerminatedVMGCThreshold)
+		syncCaches(ctx.Done())
+	})
+
+	AfterEach(func() {
+		cancel()
+		Expect(recorder.Events).To(BeEmpty())
+		ctrl.Finish()
+	})
+
+	Context("a vm scheduled to a node that gets deleted", func() {
+		It("should force-delete only the vms that were scheduled to it", func() {
+			node := NewHealthyNode("testnode")
+			vm := NewRunningVirtualMachine("vm1", node)
+			otherVm := NewRunningVirtualMachine("vm2", NewHealthyNode("othernode"))
+
+			vmInformer.GetStore().Add(vm)
+			controller.indexVirtualMachine(vm)
+			vmInformer.GetStore().Add(otherVm)
+			controller.indexVirtualMachine(otherVm)
+
+			mockQueue.ExpectAdds(1)
+			nodeSource.Delete(node)
+			mockQueue.Wait()
+
+			vmInterface.EXPECT().Delete(vm.Name, gomock.Any()).Do(func(_ string, options *v1.DeleteOptions) {
+				Expect(*options.GracePeriodSeconds).To(Equal(int64(0)))
+				Expect(*options.Preconditions.UID).To(Equal(vm.UID))
+			}).Return(nil)
+
+			controller.Execute(ctx)
+		})
+
+		It("should not delete a vm that was rescheduled to a live node while its delete was queued", func() {
+			node := NewHealthyNode("testnode")
+			vm := NewRunningVirtualMachine("vm1", node)
+
+			vmInformer.GetStore().Add(vm)
+			controller.indexVirtualMachine(vm)
+			nodeInformer.GetStore().Add(NewHealthyNode("othernode"))
+
+			mockQueue.ExpectAdds(1)
+			nodeSource.Delete(node)
+			mockQueue.Wait()
+
+			rescheduled := vm.DeepCopy()
+			rescheduled.Labels[virtv1.NodeNameLabel] = "othernode"
+			vmInformer.GetStore().Update(rescheduled)
+
+			// othernode is still live, so the VM is no longer ours to
+			// force-delete even though the queue item still names it.
+			Expect(controller.Execute(ctx)).To(BeTrue())
+		})
+
+		It("should stop tracking a vm once it is rescheduled to a different node", func() {
+			node := NewHealthyNode("testnode")
+			vm := NewRunningVirtualMachine("vm1", node)
+
+			vmInformer.GetStore().Add(vm)
+			controller.indexVirtualMachine(vm)
+
+			rescheduled := vm.DeepCopy()
+			rescheduled.Labels[virtv1.NodeNameLabel] = "othernode"
+			controller.updateVirtualMachine(vm, rescheduled)
+
+			nodeSource.Delete(node)
+			Consistently(func() int { return controller.Queue.Len() }).Should(Equal(0))
+		})
+	})
+
+	Context("a namespace with more terminated vms than the threshold", func() {
+		BeforeEach(func() {
+			newController(2)
+		})
+
+		It("should delete the oldest terminated vms down to the threshold", func() {
+			oldest := NewRunningVirtualMachine("oldest", NewHealthyNode("testnode"))
+			oldest.Status.Phase = virtv1.Succeeded
+			oldest.CreationTimestamp = v1.NewTime(v1.Now().Add(-3 * time.Hour))
+
+			middle := NewRunningVirtualMachine("middle", NewHealthyNode("testnode"))
+			middle.Status.Phase = virtv1.Failed
+			middle.CreationTimestamp = v1.NewTime(v1.Now().Add(-2 * time.Hour))
+
+			newest := NewRunningVirtualMachine("newest", NewHealthyNode("testnode"))
+			newest.Status.Phase = virtv1.Succeeded
+			newest.CreationTimestamp = v1.NewTime(v1.Now().Add(-1 * time.Hour))
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{
+				Items: []virtv1.VirtualMachine{*oldest, *middle, *newest},
+			}, nil)
+			vmInterface.EXPECT().Delete(oldest.Name, gomock.Any()).Return(nil)
+
+			Expect(controller.execute(ctx, vmGCPruneKeyPrefix+oldest.Namespace)).To(Succeed())
+		})
+
+		It("should do nothing when the namespace is at or below the threshold", func() {
+			vm := NewRunningVirtualMachine("vm1", NewHealthyNode("testnode"))
+			vm.Status.Phase = virtv1.Succeeded
+
+			vmInterface.EXPECT().List(gomock.Any()).Return(&virtv1.VirtualMachineList{
+				Items: []virtv1.VirtualMachine{*vm},
+			}, nil)
+
+			Expect(controller.execute(ctx, vmGCPruneKeyPrefix+vm.Namespace)).To(Succeed())
+		})
+	})
+})